@@ -2,20 +2,38 @@ package internal
 
 import (
 	"archive/zip"
+	"bytes"
 	"debug/elf"
 	"fmt"
 	"io"
 	"io/fs"
 	"io/ioutil"
+	"os"
 	"strings"
 )
 
 type SafeELFFile struct {
 	*elf.File
+
+	// closer, if set, is released by Close in addition to *elf.File's own
+	// closer. elf.NewFile (unlike elf.Open) never wires up *elf.File's
+	// closer itself, so this is how OpenSafeELFFileFS tracks the extra
+	// archive layers and file handles it opens.
+	closer io.Closer
 }
 
-type ZipFileReaderAt struct {
-	Data []byte
+// Close releases the underlying ELF file along with any extra resources
+// (archive layers, additional file handles) SafeELFFile was opened with.
+func (se *SafeELFFile) Close() error {
+	err := se.File.Close()
+	if se.closer == nil {
+		return err
+	}
+
+	if cerr := se.closer.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // NewSafeELFFile reads an ELF safely.
@@ -40,78 +58,284 @@ func NewSafeELFFile(r io.ReaderAt) (safe *SafeELFFile, err error) {
 		return nil, err
 	}
 
-	return &SafeELFFile{file}, nil
+	return &SafeELFFile{File: file}, nil
 }
 
 // OpenSafeELFFile reads an ELF from a file.
 //
+// path may chain through nested archives with "!", e.g.
+// "a.aab!base.apk!lib/arm64-v8a/libfoo.so". See OpenSafeELFFileFS for the
+// general form of this syntax.
+//
 // It works like NewSafeELFFile, with the exception that safe.Close will
 // close the underlying file.
 func OpenSafeELFFile(path string) (safe *SafeELFFile, err error) {
-	var file *elf.File
+	if !strings.Contains(path, "!") {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+
+			safe = nil
+			err = fmt.Errorf("reading ELF file panicked: %s", r)
+		}()
+
+		file, err := elf.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SafeELFFile{File: file}, nil
+	}
+
+	return OpenSafeELFFileFS(osRootFS{}, path)
+}
+
+// osRootFS adapts the local filesystem to fs.FS without the path
+// restrictions fs.ValidPath imposes, so it can open the absolute or
+// relative paths OpenSafeELFFile and friends are called with.
+type osRootFS struct{}
+
+func (osRootFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// multiCloser closes a chain of io.Closer in order, continuing past errors
+// and returning the first one encountered.
+type multiCloser []io.Closer
+
+func (m multiCloser) Close() error {
+	var err error
+	for _, c := range m {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// readerAtSize returns an io.ReaderAt over f's contents and its size. Files
+// that are already an io.ReaderAt (such as *os.File) are used directly;
+// anything else (such as a compressed zip entry) is buffered in memory.
+func readerAtSize(f fs.File) (io.ReaderAt, int64, error) {
+	if ra, ok := f.(io.ReaderAt); ok {
+		info, err := f.Stat()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return ra, info.Size(), nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// zipEntryReaderAt looks up name among zr's entries and, if it is STORED
+// (uncompressed), returns an io.ReaderAt that reads its bytes directly out
+// of base, the reader backing zr. This avoids buffering the entry in memory,
+// which matters when it's a large shared library rather than a nested
+// archive index.
+//
+// ok is false if name isn't present or isn't STORED; callers should fall
+// back to opening it as an fs.File in that case.
+func zipEntryReaderAt(zr *zip.Reader, base io.ReaderAt, name string) (ra io.ReaderAt, ok bool, err error) {
+	for _, f := range zr.File {
+		if f.Name != name || f.Method != zip.Store {
+			continue
+		}
+
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, false, err
+		}
+
+		return io.NewSectionReader(base, offset, int64(f.UncompressedSize64)), true, nil
+	}
+
+	return nil, false, nil
+}
+
+// OpenSafeELFFileFS reads an ELF named name out of fsys.
+//
+// name may chain through nested archives with "!", e.g.
+// "a.aab!base.apk!lib/arm64-v8a/libfoo.so": every "!"-separated component
+// before the last is opened and re-exposed as an fs.FS holding the next
+// component, currently by treating it as a zip archive. Callers that need
+// other container formats - squashfs, overlay, in-memory test fixtures -
+// can implement fs.FS themselves and pass it as fsys. The final component
+// may carry an "@suffix", which is accepted and discarded, for callers that
+// annotate the entry name.
+//
+// It works like NewSafeELFFile, with the exception that safe.Close releases
+// every archive layer and file handle opened along the way.
+func OpenSafeELFFileFS(fsys fs.FS, name string) (safe *SafeELFFile, err error) {
+	var closers multiCloser
 	defer func() {
 		r := recover()
-		if r == nil {
+		if r == nil && err == nil {
 			return
 		}
 
+		closers.Close()
 		safe = nil
-		err = fmt.Errorf("reading ELF file panicked: %s", r)
+		if r != nil {
+			err = fmt.Errorf("reading ELF file panicked: %s", r)
+		}
 	}()
 
-	//check is there "!" in path
-	if strings.Contains(path, "!") {
-		file, err = OpenZipELFFile(path)
-	} else {
-		file, err = elf.Open(path)
+	layers := strings.Split(name, "!")
+
+	var ra io.ReaderAt
+	for _, layer := range layers[:len(layers)-1] {
+		f, err := fsys.Open(layer)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, f)
+
+		var size int64
+		ra, size, err = readerAtSize(f)
+		if err != nil {
+			return nil, err
+		}
+
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return nil, err
+		}
+
+		fsys = zr
 	}
-	if err != nil {
-		return nil, err
+
+	leaf := strings.Split(layers[len(layers)-1], "@")[0]
+
+	var leafRA io.ReaderAt
+	if zr, ok := fsys.(*zip.Reader); ok && ra != nil {
+		direct, found, err := zipEntryReaderAt(zr, ra, leaf)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			leafRA = direct
+		}
 	}
 
-	return &SafeELFFile{file}, nil
-}
+	if leafRA == nil {
+		f, err := fsys.Open(leaf)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, f)
+
+		leafRA, _, err = readerAtSize(f)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-func NewZipFileReaderAt(file fs.File) (*ZipFileReaderAt, error) {
-	data, err := ioutil.ReadAll(file)
+	file, err := elf.NewFile(leafRA)
 	if err != nil {
 		return nil, err
 	}
 
-	return &ZipFileReaderAt{Data: data}, nil
+	return &SafeELFFile{File: file, closer: closers}, nil
 }
 
-func (z *ZipFileReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
-	// 检查偏移量是否超出范围
-	if off >= int64(len(z.Data)) {
-		return 0, io.EOF
-	}
-
-	// 读取数据
-	n = copy(p, z.Data[off:])
-	return n, nil
+// OpenAPKELF reads the ELF named entryName out of the zip archive at
+// apkPath, e.g. an Android APK's native library.
+//
+// It works like OpenSafeELFFile, with the exception that safe.Close releases
+// both the zip entry's file handle and the APK's.
+func OpenAPKELF(apkPath, entryName string) (safe *SafeELFFile, err error) {
+	return OpenSafeELFFileFS(osRootFS{}, apkPath+"!"+entryName)
 }
 
-func OpenZipELFFile(path string) (elfFile *elf.File, err error) {
-	// println("path", path)
-	apkFileStr := strings.Split(path, "!")
-	archive, err := zip.OpenReader(apkFileStr[0])
+// OpenELFEmbeddedZip opens path as both an ELF file and a zip archive
+// embedded inside it, e.g. a self-contained loader binary that bundles its
+// CO-RE BTF archives, map definitions and auxiliary BPF object files as a
+// zip payload.
+//
+// The zip payload may live inside one of the ELF's sections, or be appended
+// after the ELF image, following the same convention used by self-extracting
+// binaries: each section is tried as a zip archive in turn, and if none of
+// them are, a zip directory is looked for right after the furthest end of
+// any section stored in the file (every section but SHT_NOBITS, loadable or
+// not).
+//
+// It works like OpenSafeELFFile, with the exception that safe.Close also
+// releases the underlying file.
+func OpenELFEmbeddedZip(path string) (zr *zip.Reader, safe *SafeELFFile, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		zr, safe = nil, nil
+		err = fmt.Errorf("reading ELF file panicked: %s", r)
+	}()
+
+	file, err := elf.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+		}
+	}()
+
+	var max int64
+	for _, sect := range file.Sections {
+		if sect.Type == elf.SHT_NOBITS {
+			continue
+		}
+
+		if end := int64(sect.Offset + sect.FileSize); end > max {
+			max = end
+		}
+
+		if sect.ReaderAt == nil || sect.Flags&elf.SHF_COMPRESSED != 0 {
+			// Compressed sections can't be read with ReadAt, so they can't
+			// be probed as a zip archive; they still count towards max.
+			continue
+		}
+
+		if embedded, zerr := zip.NewReader(sect, int64(sect.Size)); zerr == nil {
+			return embedded, &SafeELFFile{File: file}, nil
+		}
 	}
-	f, err := archive.Open(strings.Split(apkFileStr[1], "@")[0])
+
+	// None of the sections held a zip archive: look for one appended after
+	// the ELF image. elf.File doesn't expose the ReaderAt it was parsed
+	// from, so open the file again to seek past it.
+	rda, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	readerAt, err := NewZipFileReaderAt(f)
+	defer func() {
+		if err != nil {
+			rda.Close()
+		}
+	}()
+
+	size, err := rda.Seek(0, io.SeekEnd)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	elfFile, err = elf.NewFile(readerAt)
+
+	appended, err := zip.NewReader(io.NewSectionReader(rda, max, size-max), size-max)
 	if err != nil {
-		return nil, err
+		return nil, nil, fmt.Errorf("no zip payload found in %s: %w", path, err)
 	}
-	return elfFile, nil
+
+	return appended, &SafeELFFile{File: file, closer: rda}, nil
 }
 
 // Symbols is the safe version of elf.File.Symbols.
@@ -156,3 +380,169 @@ func (se *SafeELFFile) SectionsByType(typ elf.SectionType) []*elf.Section {
 	}
 	return sections
 }
+
+// ProgramHeaders is the safe version of elf.File.Progs.
+func (se *SafeELFFile) ProgramHeaders() (progs []*elf.Prog, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		progs = nil
+		err = fmt.Errorf("reading ELF program headers panicked: %s", r)
+	}()
+
+	return se.File.Progs, nil
+}
+
+// FileOffsetToVirtualAddr translates a file offset into the virtual address
+// it is loaded at, by finding the PT_LOAD segment that contains it. This is
+// the computation uprobe attachment needs after resolving a symbol's file
+// offset, to get the address perf_event_open expects.
+//
+// It takes an ELFImage rather than a *SafeELFFile so that callers can
+// exercise it against a MockELF's synthetic program headers in tests.
+func FileOffsetToVirtualAddr(img ELFImage, off uint64) (addr uint64, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		addr = 0
+		err = fmt.Errorf("translating ELF file offset panicked: %s", r)
+	}()
+
+	progs, err := img.ProgramHeaders()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, prog := range progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+
+		if off >= prog.Off && off < prog.Off+prog.Filesz {
+			return off - prog.Off + prog.Vaddr, nil
+		}
+	}
+
+	return 0, fmt.Errorf("file offset %#x is not contained in any PT_LOAD segment", off)
+}
+
+// VirtualAddrToFileOffset is the inverse of FileOffsetToVirtualAddr.
+func VirtualAddrToFileOffset(img ELFImage, addr uint64) (off uint64, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		off = 0
+		err = fmt.Errorf("translating ELF virtual address panicked: %s", r)
+	}()
+
+	progs, err := img.ProgramHeaders()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, prog := range progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+
+		if addr >= prog.Vaddr && addr < prog.Vaddr+prog.Memsz {
+			return addr - prog.Vaddr + prog.Off, nil
+		}
+	}
+
+	return 0, fmt.Errorf("virtual address %#x is not contained in any PT_LOAD segment", addr)
+}
+
+// Note type tags, as used by the Elf_Nhdr descriptors below.
+const (
+	noteTypeGNUBuildID = 3 // NT_GNU_BUILD_ID, name "GNU"
+	noteTypeGoBuildID  = 4 // written by cmd/link, name "Go"
+)
+
+// findNote scans sectionName for a SHT_NOTE entry with the given name and
+// type, and returns its descriptor bytes. Each note is laid out as
+// Elf_Nhdr (namesz, descsz, type, all 32-bit in the file's byte order)
+// followed by name and descriptor, each padded up to a 4-byte boundary.
+func (se *SafeELFFile) findNote(sectionName, name string, typ uint32) (desc []byte, err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+
+		desc = nil
+		err = fmt.Errorf("reading ELF notes panicked: %s", r)
+	}()
+
+	section := se.Section(sectionName)
+	if section == nil {
+		return nil, fmt.Errorf("section %s not found", sectionName)
+	}
+
+	data, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	for len(data) >= 12 {
+		nameSize := se.ByteOrder.Uint32(data[0:4])
+		descSize := se.ByteOrder.Uint32(data[4:8])
+		noteType := se.ByteOrder.Uint32(data[8:12])
+		data = data[12:]
+
+		noteName := trimNoteName(data[:nameSize])
+		data = data[align4(nameSize):]
+
+		noteDesc := data[:descSize]
+		data = data[align4(descSize):]
+
+		if noteType == typ && noteName == name {
+			return noteDesc, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %q note of type %d in section %s", name, typ, sectionName)
+}
+
+// trimNoteName strips the NUL terminator and 4-byte alignment padding an ELF
+// note name is stored with, e.g. "GNU\0" or "Go\0\0".
+func trimNoteName(b []byte) string {
+	return string(bytes.TrimRight(b, "\x00"))
+}
+
+// align4 rounds n up to the next 4-byte boundary, the padding ELF notes use
+// between their name and descriptor fields.
+func align4(n uint32) uint32 {
+	return (n + 3) &^ 3
+}
+
+// BuildID returns the raw descriptor of the .note.gnu.build-id note, the
+// identifier the linker's --build-id assigns to the binary. Symbol caches
+// can key on it to find a stripped binary's matching debug info, e.g. under
+// /usr/lib/debug/.build-id/xx/yyyy.debug.
+func (se *SafeELFFile) BuildID() ([]byte, error) {
+	return se.findNote(".note.gnu.build-id", "GNU", noteTypeGNUBuildID)
+}
+
+// GoBuildID returns the descriptor of the .note.go.buildid note that
+// cmd/link writes into binaries built by the Go toolchain. Unlike BuildID,
+// the descriptor is already the human-readable build ID string printed by
+// `go tool buildid`/`go version -m`, not a binary digest, so it's returned
+// as-is rather than hex-encoded.
+func (se *SafeELFFile) GoBuildID() (string, error) {
+	desc, err := se.findNote(".note.go.buildid", "Go", noteTypeGoBuildID)
+	if err != nil {
+		return "", err
+	}
+
+	return string(desc), nil
+}
@@ -0,0 +1,333 @@
+package internal
+
+import (
+	"archive/zip"
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testELFBytes returns the bytes of a real, valid ELF file to use as a test
+// fixture: the test binary itself. This also means it carries whatever a
+// real `go build` output carries - a .note.go.buildid note and, when the
+// binary is linked with DWARF (as `go test -c` does; a plain `go test` run
+// omits it), compressed DWARF debug sections - which is exactly the input
+// the bugs below were found against.
+func testELFBytes(t *testing.T) []byte {
+	t.Helper()
+
+	if runtime.GOOS != "linux" {
+		t.Skip("test fixture assumes an ELF binary")
+	}
+
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatalf("os.Executable: %s", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("reading test binary: %s", err)
+	}
+
+	return data
+}
+
+// buildNote encodes a single ELF note in the Elf_Nhdr layout findNote
+// parses: a namesz/descsz/type header followed by the name and descriptor,
+// each padded out to a 4-byte boundary.
+func buildNote(name string, typ uint32, desc []byte) []byte {
+	nameBytes := append([]byte(name), 0)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(nameBytes)))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(desc)))
+	binary.Write(&buf, binary.LittleEndian, typ)
+	buf.Write(nameBytes)
+	buf.Write(make([]byte, align4(uint32(len(nameBytes)))-uint32(len(nameBytes))))
+	buf.Write(desc)
+	buf.Write(make([]byte, align4(uint32(len(desc)))-uint32(len(desc))))
+
+	return buf.Bytes()
+}
+
+// buildMinimalELFWithNoteSection returns a minimal, valid little-endian
+// ELF64 file containing a single SHT_NOTE section named sectionName with
+// noteData as its contents, so findNote's real section-data parsing can be
+// exercised deterministically instead of depending on whatever notes the
+// host toolchain happens to emit.
+func buildMinimalELFWithNoteSection(sectionName string, noteData []byte) []byte {
+	const ehsize = 64
+	const shentsize = 64
+
+	shstrtab := []byte{0}
+	nameOff := len(shstrtab)
+	shstrtab = append(shstrtab, append([]byte(sectionName), 0)...)
+	shstrtabNameOff := len(shstrtab)
+	shstrtab = append(shstrtab, ".shstrtab"...)
+	shstrtab = append(shstrtab, 0)
+
+	noteOff := ehsize
+	shstrtabOff := noteOff + len(noteData)
+	shoff := shstrtabOff + len(shstrtab)
+
+	var buf bytes.Buffer
+
+	// e_ident
+	buf.Write([]byte{0x7f, 'E', 'L', 'F', 2 /* ELFCLASS64 */, 1, /* ELFDATA2LSB */
+		1 /* EV_CURRENT */, 0 /* ELFOSABI_NONE */, 0})
+	buf.Write(make([]byte, 7)) // e_ident padding
+
+	binary.Write(&buf, binary.LittleEndian, uint16(elf.ET_EXEC))
+	binary.Write(&buf, binary.LittleEndian, uint16(elf.EM_X86_64))
+	binary.Write(&buf, binary.LittleEndian, uint32(1)) // e_version
+	binary.Write(&buf, binary.LittleEndian, uint64(0)) // e_entry
+	binary.Write(&buf, binary.LittleEndian, uint64(0)) // e_phoff
+	binary.Write(&buf, binary.LittleEndian, uint64(shoff))
+	binary.Write(&buf, binary.LittleEndian, uint32(0)) // e_flags
+	binary.Write(&buf, binary.LittleEndian, uint16(ehsize))
+	binary.Write(&buf, binary.LittleEndian, uint16(0)) // e_phentsize
+	binary.Write(&buf, binary.LittleEndian, uint16(0)) // e_phnum
+	binary.Write(&buf, binary.LittleEndian, uint16(shentsize))
+	binary.Write(&buf, binary.LittleEndian, uint16(3)) // e_shnum: null, note, shstrtab
+	binary.Write(&buf, binary.LittleEndian, uint16(2)) // e_shstrndx
+
+	buf.Write(noteData)
+	buf.Write(shstrtab)
+
+	// Section 0: the mandatory null section.
+	buf.Write(make([]byte, shentsize))
+
+	writeShdr := func(name uint32, typ elf.SectionType, offset, size, addralign uint64) {
+		binary.Write(&buf, binary.LittleEndian, name)
+		binary.Write(&buf, binary.LittleEndian, uint32(typ))
+		binary.Write(&buf, binary.LittleEndian, uint64(0)) // sh_flags
+		binary.Write(&buf, binary.LittleEndian, uint64(0)) // sh_addr
+		binary.Write(&buf, binary.LittleEndian, offset)
+		binary.Write(&buf, binary.LittleEndian, size)
+		binary.Write(&buf, binary.LittleEndian, uint32(0)) // sh_link
+		binary.Write(&buf, binary.LittleEndian, uint32(0)) // sh_info
+		binary.Write(&buf, binary.LittleEndian, addralign)
+		binary.Write(&buf, binary.LittleEndian, uint64(0)) // sh_entsize
+	}
+
+	// Section 1: the note section under test.
+	writeShdr(uint32(nameOff), elf.SHT_NOTE, uint64(noteOff), uint64(len(noteData)), 4)
+	// Section 2: .shstrtab.
+	writeShdr(uint32(shstrtabNameOff), elf.SHT_STRTAB, uint64(shstrtabOff), uint64(len(shstrtab)), 1)
+
+	return buf.Bytes()
+}
+
+func writeZipEntry(t *testing.T, path, name string, method uint16, data []byte) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenSafeELFFileZip(t *testing.T) {
+	elfData := testELFBytes(t)
+
+	for _, tc := range []struct {
+		name   string
+		method uint16
+	}{
+		{"stored", zip.Store},
+		{"deflated", zip.Deflate},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			zipPath := filepath.Join(dir, "test.apk")
+			writeZipEntry(t, zipPath, "lib/libfoo.so", tc.method, elfData)
+
+			safe, err := OpenSafeELFFile(zipPath + "!lib/libfoo.so")
+			if err != nil {
+				t.Fatalf("OpenSafeELFFile: %s", err)
+			}
+			defer safe.Close()
+
+			progs, err := safe.ProgramHeaders()
+			if err != nil {
+				t.Fatalf("ProgramHeaders: %s", err)
+			}
+
+			found := false
+			for _, p := range progs {
+				if p.Type == elf.PT_LOAD {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Error("expected at least one PT_LOAD program header")
+			}
+		})
+	}
+}
+
+func TestOpenSafeELFFileFSNestedArchive(t *testing.T) {
+	elfData := testELFBytes(t)
+	dir := t.TempDir()
+
+	var inner bytes.Buffer
+	izw := zip.NewWriter(&inner)
+	iw, err := izw.CreateHeader(&zip.FileHeader{Name: "lib/libfoo.so", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := iw.Write(elfData); err != nil {
+		t.Fatal(err)
+	}
+	if err := izw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outerPath := filepath.Join(dir, "app.aab")
+	// Nest the inner archive as a DEFLATE entry, so the container layer
+	// itself exercises the buffered fallback while the leaf ELF is still
+	// read directly off the STORED entry inside it.
+	writeZipEntry(t, outerPath, "base.apk", zip.Deflate, inner.Bytes())
+
+	safe, err := OpenSafeELFFile(outerPath + "!base.apk!lib/libfoo.so")
+	if err != nil {
+		t.Fatalf("OpenSafeELFFile: %s", err)
+	}
+	defer safe.Close()
+
+	progs, err := safe.ProgramHeaders()
+	if err != nil {
+		t.Fatalf("ProgramHeaders: %s", err)
+	}
+	if len(progs) == 0 {
+		t.Error("expected at least one program header")
+	}
+}
+
+func TestOpenELFEmbeddedZip(t *testing.T) {
+	elfData := testELFBytes(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "loader")
+
+	var payload bytes.Buffer
+	zw := zip.NewWriter(&payload)
+	w, err := zw.Create("btf/vmlinux.btf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("fake btf blob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// When the test binary is linked with DWARF (e.g. built with
+	// `go test -c`), its debug sections are compressed, so this also
+	// exercises skipping them while probing for an embedded zip.
+	combined := append(append([]byte{}, elfData...), payload.Bytes()...)
+	if err := os.WriteFile(path, combined, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, safe, err := OpenELFEmbeddedZip(path)
+	if err != nil {
+		t.Fatalf("OpenELFEmbeddedZip: %s", err)
+	}
+	defer safe.Close()
+
+	f, err := zr.Open("btf/vmlinux.btf")
+	if err != nil {
+		t.Fatalf("opening embedded entry: %s", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "fake btf blob" {
+		t.Errorf("got %q", data)
+	}
+}
+
+func TestSafeELFFileBuildIDs(t *testing.T) {
+	elfData := testELFBytes(t)
+
+	safe, err := NewSafeELFFile(bytes.NewReader(elfData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer safe.Close()
+
+	goID, err := safe.GoBuildID()
+	if err != nil {
+		t.Fatalf("GoBuildID: %s", err)
+	}
+	if len(goID) == 0 {
+		t.Error("expected a non-empty Go build ID")
+	}
+
+	if _, err := safe.BuildID(); err != nil {
+		t.Logf("BuildID: %s (binary may not carry a GNU build-id note)", err)
+	}
+}
+
+// TestSafeELFFileGNUBuildID exercises findNote's real namesz/descsz/padding
+// parsing of .note.gnu.build-id against a hand-built note, rather than
+// relying on whether the host toolchain's own test binary happens to carry
+// one.
+func TestSafeELFFileGNUBuildID(t *testing.T) {
+	want := []byte{0xde, 0xad, 0xbe, 0xef, 0x01}
+	note := buildNote("GNU", noteTypeGNUBuildID, want)
+	elfData := buildMinimalELFWithNoteSection(".note.gnu.build-id", note)
+
+	safe, err := NewSafeELFFile(bytes.NewReader(elfData))
+	if err != nil {
+		t.Fatalf("NewSafeELFFile: %s", err)
+	}
+	defer safe.Close()
+
+	got, err := safe.BuildID()
+	if err != nil {
+		t.Fatalf("BuildID: %s", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("BuildID() = %x, want %x", got, want)
+	}
+}
+
+func TestTrimNoteName(t *testing.T) {
+	for _, tc := range []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte("GNU\x00"), "GNU"},
+		{[]byte("Go\x00\x00"), "Go"},
+		{[]byte("Go\x00"), "Go"},
+	} {
+		if got := trimNoteName(tc.in); got != tc.want {
+			t.Errorf("trimNoteName(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
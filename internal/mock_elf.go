@@ -0,0 +1,69 @@
+package internal
+
+import "debug/elf"
+
+// ELFImage is the subset of SafeELFFile that the rest of this module
+// consumes. Code that only needs to read symbols, sections or program
+// headers should accept an ELFImage instead of a *SafeELFFile, so that
+// tests can inject a MockELF in place of a real, parsed ELF file.
+type ELFImage interface {
+	Symbols() ([]elf.Symbol, error)
+	DynamicSymbols() ([]elf.Symbol, error)
+	SectionsByType(typ elf.SectionType) []*elf.Section
+	ProgramHeaders() ([]*elf.Prog, error)
+	BuildID() ([]byte, error)
+	GoBuildID() (string, error)
+}
+
+var _ ELFImage = (*SafeELFFile)(nil)
+
+// MockELF is an in-memory ELFImage backed by plain slices, for tests that
+// need a malformed or edge-case ELF (a zero-length symbol table, an
+// oversized section, a bogus relocation type) without synthesizing and
+// parsing a real ELF file from disk.
+type MockELF struct {
+	SymbolsSlice        []elf.Symbol
+	DynamicSymbolsSlice []elf.Symbol
+	Sections            []*elf.Section
+	ProgramHeadersSlice []*elf.Prog
+	ID                  []byte
+	GoID                string
+}
+
+// Symbols implements ELFImage.
+func (m *MockELF) Symbols() ([]elf.Symbol, error) {
+	return m.SymbolsSlice, nil
+}
+
+// DynamicSymbols implements ELFImage.
+func (m *MockELF) DynamicSymbols() ([]elf.Symbol, error) {
+	return m.DynamicSymbolsSlice, nil
+}
+
+// SectionsByType implements ELFImage.
+func (m *MockELF) SectionsByType(typ elf.SectionType) []*elf.Section {
+	sections := make([]*elf.Section, 0, 1)
+	for _, section := range m.Sections {
+		if section.Type == typ {
+			sections = append(sections, section)
+		}
+	}
+	return sections
+}
+
+// ProgramHeaders implements ELFImage.
+func (m *MockELF) ProgramHeaders() ([]*elf.Prog, error) {
+	return m.ProgramHeadersSlice, nil
+}
+
+// BuildID implements ELFImage.
+func (m *MockELF) BuildID() ([]byte, error) {
+	return m.ID, nil
+}
+
+// GoBuildID implements ELFImage.
+func (m *MockELF) GoBuildID() (string, error) {
+	return m.GoID, nil
+}
+
+var _ ELFImage = (*MockELF)(nil)
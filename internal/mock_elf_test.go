@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"bytes"
+	"debug/elf"
+	"testing"
+)
+
+func TestMockELF(t *testing.T) {
+	m := &MockELF{
+		SymbolsSlice:        []elf.Symbol{{Name: "foo"}},
+		DynamicSymbolsSlice: []elf.Symbol{{Name: "bar"}},
+		Sections: []*elf.Section{
+			{SectionHeader: elf.SectionHeader{Name: ".text", Type: elf.SHT_PROGBITS}},
+			{SectionHeader: elf.SectionHeader{Name: ".note.gnu.build-id", Type: elf.SHT_NOTE}},
+		},
+		ProgramHeadersSlice: []*elf.Prog{
+			{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD}},
+		},
+		ID:   []byte{1, 2, 3},
+		GoID: "go-build-id-value",
+	}
+
+	syms, err := m.Symbols()
+	if err != nil || len(syms) != 1 || syms[0].Name != "foo" {
+		t.Fatalf("Symbols() = %v, %v", syms, err)
+	}
+
+	dynSyms, err := m.DynamicSymbols()
+	if err != nil || len(dynSyms) != 1 || dynSyms[0].Name != "bar" {
+		t.Fatalf("DynamicSymbols() = %v, %v", dynSyms, err)
+	}
+
+	notes := m.SectionsByType(elf.SHT_NOTE)
+	if len(notes) != 1 || notes[0].Name != ".note.gnu.build-id" {
+		t.Fatalf("SectionsByType(SHT_NOTE) = %v", notes)
+	}
+
+	progs, err := m.ProgramHeaders()
+	if err != nil || len(progs) != 1 || progs[0].Type != elf.PT_LOAD {
+		t.Fatalf("ProgramHeaders() = %v, %v", progs, err)
+	}
+
+	id, err := m.BuildID()
+	if err != nil || !bytes.Equal(id, []byte{1, 2, 3}) {
+		t.Fatalf("BuildID() = %v, %v", id, err)
+	}
+
+	goID, err := m.GoBuildID()
+	if err != nil || goID != "go-build-id-value" {
+		t.Fatalf("GoBuildID() = %q, %v", goID, err)
+	}
+}
+
+func TestFileOffsetToVirtualAddr(t *testing.T) {
+	m := &MockELF{
+		ProgramHeadersSlice: []*elf.Prog{
+			{ProgHeader: elf.ProgHeader{Type: elf.PT_LOAD, Off: 0x1000, Filesz: 0x200, Vaddr: 0x4000, Memsz: 0x200}},
+		},
+	}
+
+	addr, err := FileOffsetToVirtualAddr(m, 0x1080)
+	if err != nil || addr != 0x4080 {
+		t.Fatalf("FileOffsetToVirtualAddr() = %#x, %v", addr, err)
+	}
+
+	if _, err := FileOffsetToVirtualAddr(m, 0x9999); err == nil {
+		t.Error("expected an error for an offset outside any PT_LOAD segment")
+	}
+
+	off, err := VirtualAddrToFileOffset(m, 0x4080)
+	if err != nil || off != 0x1080 {
+		t.Fatalf("VirtualAddrToFileOffset() = %#x, %v", off, err)
+	}
+
+	if _, err := VirtualAddrToFileOffset(m, 0x9999); err == nil {
+		t.Error("expected an error for an address outside any PT_LOAD segment")
+	}
+}